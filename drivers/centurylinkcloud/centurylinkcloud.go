@@ -1,30 +1,59 @@
 package centurylinkcloud
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"math/rand"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/CenturyLinkLabs/clcgo"
+	clc "github.com/CenturyLinkCloud/clc-sdk"
+	"github.com/CenturyLinkCloud/clc-sdk/api"
+	"github.com/CenturyLinkCloud/clc-sdk/server"
+	"github.com/CenturyLinkCloud/clc-sdk/status"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/machine/drivers"
 	"github.com/docker/machine/ssh"
 	"github.com/docker/machine/state"
+	"golang.org/x/net/context"
 )
 
 const (
-	statusWaitSeconds = 10
-	dockerConfigDir   = "/etc/docker"
-	passwordPrompt    = `Enter your CenturyLink Cloud password and press enter.
+	dockerConfigDir = "/etc/docker"
+	passwordPrompt  = `Enter your CenturyLink Cloud password and press enter.
 ****** CAUTION: YOUR PASSWORD WILL BE VISIBLE! ******
 > `
+
+	defaultOperationTimeout = 20 * time.Minute
+	defaultOperationSleep   = 2 * time.Second
+	maxOperationSleep       = 30 * time.Second
+	operationBackoffFactor  = 1.5
 )
 
+// ErrOperationTimeout is returned by waitForStatus when the cumulative time
+// spent polling a CLC status exceeds the configured operation timeout.
+var ErrOperationTimeout = errors.New("centurylinkcloud: timed out waiting for operation to complete")
+
+func init() {
+	// Reseed the global math/rand source (rather than leaving it on the
+	// default, identically-seeded one) so that concurrent `machine`
+	// processes polling the same CLC operation back off on different
+	// schedules instead of retrying in lockstep. The top-level rand
+	// functions stay safe for jitterFor to call from concurrent
+	// goroutines, unlike a standalone *rand.Rand.
+	rand.Seed(time.Now().UnixNano())
+}
+
+// WaitOptions controls how waitForStatus paces its polling of a CLC status.
+type WaitOptions struct {
+	Timeout time.Duration
+	Sleep   time.Duration
+}
+
 type Driver struct {
 	MachineName    string
 	CaCertPath     string
@@ -40,9 +69,26 @@ type Driver struct {
 	CPU            int
 	MemoryGB       int
 
-	// Allow Password to come in via flags while not being persisted to
-	// config.json.
-	Password string `json:"-"`
+	AntiAffinityPolicyID string
+	AlertPolicyID        string
+	LoadBalancerID       string
+	LoadBalancerPoolPort int
+
+	OperationTimeout string
+	OperationSleep   string
+
+	OpenTCPPorts []int
+	OpenUDPPorts []int
+
+	VaultAddr string
+	VaultPath string
+
+	UserData string
+
+	// Allow Password and VaultToken to come in via flags while not being
+	// persisted to config.json - they're both secrets.
+	Password   string `json:"-"`
+	VaultToken string `json:"-"`
 }
 
 func init() {
@@ -68,8 +114,43 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.SourceServerID = flags.String("centurylinkcloud-source-server-id")
 	d.CPU = flags.Int("centurylinkcloud-cpu")
 	d.MemoryGB = flags.Int("centurylinkcloud-memory-gb")
+	d.AntiAffinityPolicyID = flags.String("centurylinkcloud-anti-affinity-policy-id")
+	d.AlertPolicyID = flags.String("centurylinkcloud-alert-policy-id")
+	d.LoadBalancerID = flags.String("centurylinkcloud-load-balancer-id")
+	d.LoadBalancerPoolPort = flags.Int("centurylinkcloud-load-balancer-pool-port")
+	d.OperationTimeout = flags.String("centurylinkcloud-operation-timeout")
+	d.OperationSleep = flags.String("centurylinkcloud-operation-sleep")
+
+	tcpPorts, err := parsePorts(flags.StringSlice("centurylinkcloud-open-tcp-ports"))
+	if err != nil {
+		return fmt.Errorf("invalid --centurylinkcloud-open-tcp-ports: %v", err)
+	}
+	d.OpenTCPPorts = tcpPorts
 
-	if d.Username == "" {
+	udpPorts, err := parsePorts(flags.StringSlice("centurylinkcloud-open-udp-ports"))
+	if err != nil {
+		return fmt.Errorf("invalid --centurylinkcloud-open-udp-ports: %v", err)
+	}
+	d.OpenUDPPorts = udpPorts
+
+	d.VaultAddr = flags.String("centurylinkcloud-vault-addr")
+	d.VaultPath = flags.String("centurylinkcloud-vault-path")
+	d.VaultToken = flags.String("centurylinkcloud-vault-token")
+
+	if d.VaultAddr != "" && d.VaultPath == "" {
+		return fmt.Errorf("centurylinkcloud driver requires --centurylinkcloud-vault-path when --centurylinkcloud-vault-addr is set")
+	}
+
+	d.UserData = flags.String("centurylinkcloud-user-data")
+	if userDataFile := flags.String("centurylinkcloud-user-data-file"); userDataFile != "" {
+		contents, err := ioutil.ReadFile(userDataFile)
+		if err != nil {
+			return fmt.Errorf("unable to read --centurylinkcloud-user-data-file: %v", err)
+		}
+		d.UserData = string(contents)
+	}
+
+	if d.Username == "" && d.VaultAddr == "" {
 		return fmt.Errorf("centurylinkcloud driver requires the --centurylinkcloud-username option")
 	}
 
@@ -81,6 +162,10 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		return fmt.Errorf("centurylinkcloud driver requires the --centurylinkcloud-group-id option")
 	}
 
+	if d.LoadBalancerPoolPort == 0 && d.LoadBalancerID != "" {
+		return fmt.Errorf("centurylinkcloud driver requires --centurylinkcloud-load-balancer-pool-port when --centurylinkcloud-load-balancer-id is set")
+	}
+
 	return nil
 }
 
@@ -103,7 +188,21 @@ func (d *Driver) GetIP() (string, error) {
 		return address, nil
 	}
 
-	return "", errors.New("no IP could be found for this server")
+	return "", fmt.Errorf("no IP could be found for this server")
+}
+
+func (d *Driver) GetPrivateIP() (string, error) {
+	_, s, err := d.getServer()
+	if err != nil {
+		return "", err
+	}
+
+	address := privateIPFromServer(s)
+	if address != "" {
+		return address, nil
+	}
+
+	return "", fmt.Errorf("no private IP could be found for this server")
 }
 
 func (d *Driver) GetState() (state.State, error) {
@@ -127,24 +226,26 @@ func (d *Driver) Remove() error {
 		return err
 	}
 
-	st, err := c.DeleteEntity(&s)
+	if d.LoadBalancerID != "" {
+		if err := d.removeFromLoadBalancerPool(c, s); err != nil {
+			log.Errorf("failed to deregister server '%s' from load balancer pool '%s', remove it manually: %v", s.ID, d.LoadBalancerID, err)
+		}
+	}
+
+	st, err := c.Server.Delete(s.ID)
 	if err != nil {
 		return err
 	}
 
-	for !st.HasSucceeded() {
-		time.Sleep(time.Second * statusWaitSeconds)
-		if err := c.GetEntity(&st); err != nil {
-			return err
-		}
-		log.Debugf("Deletion status: %s", st.Status)
+	if err := d.waitForStatus(c, st, d.waitOptions()); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (d *Driver) Start() error {
-	if err := d.doOperation(clcgo.PowerOnServer); err != nil {
+	if err := d.doOperation(server.PowerOn); err != nil {
 		return err
 	}
 
@@ -152,7 +253,7 @@ func (d *Driver) Start() error {
 }
 
 func (d *Driver) Stop() error {
-	if err := d.doOperation(clcgo.PowerOffServer); err != nil {
+	if err := d.doOperation(server.PowerOff); err != nil {
 		return err
 	}
 
@@ -160,7 +261,7 @@ func (d *Driver) Stop() error {
 }
 
 func (d *Driver) Restart() error {
-	if err := d.doOperation(clcgo.RebootServer); err != nil {
+	if err := d.doOperation(server.Reboot); err != nil {
 		return err
 	}
 
@@ -168,7 +269,7 @@ func (d *Driver) Restart() error {
 }
 
 func (d *Driver) Kill() error {
-	if err := d.doOperation(clcgo.PowerOffServer); err != nil {
+	if err := d.doOperation(server.PowerOff); err != nil {
 		return err
 	}
 
@@ -231,24 +332,36 @@ func (d *Driver) GetSSHCommand(args ...string) (*exec.Cmd, error) {
 	return ssh.GetSSHCommand(ip, 22, "root", d.sshKeyPath(), args...), nil
 }
 
-func (d *Driver) getClientWithPersistence() (*clcgo.Client, error) {
-	c := clcgo.NewClient()
+func (d *Driver) credentialProvider() (CredentialProvider, error) {
+	if d.VaultAddr != "" {
+		return NewVaultCredentialProvider(d.VaultAddr, d.VaultPath, d.VaultToken)
+	}
+
+	return &passwordCredentialProvider{username: d.Username, password: d.Password}, nil
+}
+
+func (d *Driver) getClientWithPersistence() (*clc.Client, error) {
+	provider, err := d.credentialProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	c := clc.New(api.Config{})
 	if d.BearerToken == "" || d.AccountAlias == "" {
-		if err := d.updateAPICredentials(c); err != nil {
+		if err := d.updateAPICredentials(c, provider); err != nil {
 			return nil, err
 		}
 	} else {
-		c.APICredentials = clcgo.APICredentials{
-			BearerToken:  d.BearerToken,
-			AccountAlias: d.AccountAlias,
-		}
+		c.Config.BearerToken = d.BearerToken
+		c.Config.AccountAlias = d.AccountAlias
 
 		// Something to validate your BearerToken.
-		err := c.GetEntity(&clcgo.DataCenters{})
+		_, err := c.Group.Get(d.GroupID)
 		if err != nil {
-			if rerr, ok := err.(clcgo.RequestError); ok && rerr.StatusCode == 401 {
-				err := d.updateAPICredentials(c)
-				if err != nil {
+			if rerr, ok := err.(api.RequestError); ok && rerr.StatusCode == 401 {
+				// The token has expired - fetch fresh credentials from the provider
+				// (the password provider prompts on stdin when no password was given).
+				if err := d.updateAPICredentials(c, provider); err != nil {
 					return c, err
 				}
 
@@ -262,47 +375,43 @@ func (d *Driver) getClientWithPersistence() (*clcgo.Client, error) {
 	return c, nil
 }
 
-func (d *Driver) updateAPICredentials(c *clcgo.Client) error {
-	var password string
-	if d.Password != "" {
-		password = d.Password
+// updateAPICredentials fetches fresh credentials from provider and persists
+// only what's safe to write to config.json (never a Vault-issued token).
+func (d *Driver) updateAPICredentials(c *clc.Client, provider CredentialProvider) error {
+	creds, err := provider.Fetch(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if creds.BearerToken != "" {
+		c.Config.BearerToken = creds.BearerToken
+		c.Config.AccountAlias = creds.AccountAlias
 	} else {
-		fmt.Printf(passwordPrompt)
-		reader := bufio.NewReader(os.Stdin)
-		input, err := reader.ReadString('\n')
-		if err != nil {
+		c.Config.Username = creds.Username
+		c.Config.Password = creds.Password
+		if err := c.Authenticate(); err != nil {
 			return err
 		}
-		password = strings.TrimSpace(input)
 	}
 
-	if err := c.GetAPICredentials(d.Username, password); err != nil {
-		return err
+	d.AccountAlias = c.Config.AccountAlias
+	if _, vaultBacked := provider.(*VaultCredentialProvider); !vaultBacked {
+		d.BearerToken = c.Config.BearerToken
 	}
-	d.AccountAlias = c.APICredentials.AccountAlias
-	d.BearerToken = c.APICredentials.BearerToken
-	// TODO: You need to be able to persist the config.json at this point! On
-	// initial setup it will be persisted, but in two weeks when your
-	// BearerToken has expired and this blows up during another call, the new
-	// values are never persisted.
 
 	return nil
 }
 
-func (d *Driver) getServer() (*clcgo.Client, clcgo.Server, error) {
-	s := clcgo.Server{ID: d.ServerID}
+func (d *Driver) getServer() (*clc.Client, server.Server, error) {
 	c, err := d.getClientWithPersistence()
 	if err != nil {
-		return nil, s, err
+		return nil, server.Server{}, err
 	}
 
-	err = c.GetEntity(&s)
-
+	s, err := c.Server.Get(d.ServerID)
 	if err != nil {
-		if rerr, ok := err.(clcgo.RequestError); ok {
-			if rerr.StatusCode == 404 {
-				return nil, s, fmt.Errorf("unable to find a server with the ID '%s'", d.ServerID)
-			}
+		if rerr, ok := err.(api.RequestError); ok && rerr.StatusCode == 404 {
+			return nil, s, fmt.Errorf("unable to find a server with the ID '%s'", d.ServerID)
 		}
 
 		return nil, s, err
@@ -311,32 +420,105 @@ func (d *Driver) getServer() (*clcgo.Client, clcgo.Server, error) {
 	return c, s, nil
 }
 
-func (d *Driver) doOperation(t clcgo.OperationType) error {
+func (d *Driver) doOperation(t server.PowerOperation) error {
 	c, s, err := d.getServer()
 	if err != nil {
 		return err
 	}
 
 	log.Infof("Performing '%s' operation on '%s'...", t, s.ID)
-	o := clcgo.ServerOperation{Server: s, OperationType: t}
-	st, err := c.SaveEntity(&o)
+	st, err := c.Server.ExecutePowerOperation(s.ID, t)
 	if err != nil {
-		return nil
+		return err
+	}
+
+	return d.waitForStatus(c, st, d.waitOptions())
+}
+
+func hasSucceeded(st status.Status) bool {
+	return strings.EqualFold(st.Status, "succeeded")
+}
+
+func hasFailed(st status.Status) bool {
+	return strings.EqualFold(st.Status, "failed")
+}
+
+// nextOperationSleep grows sleep by operationBackoffFactor, capped at maxOperationSleep.
+func nextOperationSleep(sleep time.Duration) time.Duration {
+	sleep = time.Duration(float64(sleep) * operationBackoffFactor)
+	if sleep > maxOperationSleep {
+		sleep = maxOperationSleep
+	}
+	return sleep
+}
+
+// jitterFor returns a random duration in [0, sleep/2] to avoid synchronizing retries against the API.
+func jitterFor(sleep time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(sleep)/2 + 1))
+}
+
+func (d *Driver) waitOptions() WaitOptions {
+	opts := WaitOptions{Timeout: defaultOperationTimeout, Sleep: defaultOperationSleep}
+
+	if d.OperationTimeout != "" {
+		if t, err := time.ParseDuration(d.OperationTimeout); err == nil {
+			opts.Timeout = t
+		} else {
+			log.Warnf("ignoring invalid --centurylinkcloud-operation-timeout %q: %v", d.OperationTimeout, err)
+		}
+	}
+
+	if d.OperationSleep != "" {
+		if t, err := time.ParseDuration(d.OperationSleep); err == nil {
+			opts.Sleep = t
+		} else {
+			log.Warnf("ignoring invalid --centurylinkcloud-operation-sleep %q: %v", d.OperationSleep, err)
+		}
 	}
 
-	for !st.HasSucceeded() {
-		time.Sleep(time.Second * statusWaitSeconds)
-		if err := c.GetEntity(&st); err != nil {
+	return opts
+}
+
+// waitForStatus polls st with exponential backoff until it succeeds, fails, or opts.Timeout elapses.
+func (d *Driver) waitForStatus(c *clc.Client, st status.Status, opts WaitOptions) error {
+	sleep := opts.Sleep
+	if sleep <= 0 {
+		sleep = defaultOperationSleep
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultOperationTimeout
+	}
+
+	start := time.Now()
+	for !hasSucceeded(st) {
+		if hasFailed(st) {
+			return fmt.Errorf("centurylinkcloud: operation %s ended in status %q", st.ID, st.Status)
+		}
+
+		elapsed := time.Since(start)
+		if elapsed > timeout {
+			return ErrOperationTimeout
+		}
+
+		wait := sleep + jitterFor(sleep)
+		log.Infof("Retrying in %s (elapsed/timeout: %s/%s)", wait, elapsed, timeout)
+		time.Sleep(wait)
+
+		sleep = nextOperationSleep(sleep)
+
+		var err error
+		if st, err = c.Status.Get(st.ID); err != nil {
 			return err
 		}
-		log.Debugf("Operation status: %s", st.Status)
+		log.Debugf("Status: %s", st.Status)
 	}
 
 	return nil
 }
 
 func logAndReturnError(err error) error {
-	if rerr, ok := err.(clcgo.RequestError); ok {
+	if rerr, ok := err.(api.RequestError); ok {
 		for f, ms := range rerr.Errors {
 			for _, m := range ms {
 				log.Errorf("%v: %v", f, m)
@@ -349,9 +531,8 @@ func logAndReturnError(err error) error {
 	return err
 }
 
-func publicIPFromServer(s clcgo.Server) string {
-	addresses := s.Details.IPAddresses
-	for _, a := range addresses {
+func publicIPFromServer(s server.Server) string {
+	for _, a := range s.Details.IPAddresses {
 		if a.Public != "" {
 			return a.Public
 		}
@@ -360,6 +541,40 @@ func publicIPFromServer(s clcgo.Server) string {
 	return ""
 }
 
+func parsePorts(raw []string) ([]int, error) {
+	ports := make([]int, 0, len(raw))
+	for _, r := range raw {
+		p, err := strconv.Atoi(r)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+
+	return ports, nil
+}
+
+func privateIPFromServer(s server.Server) string {
+	for _, a := range s.Details.IPAddresses {
+		if a.Internal != "" {
+			return a.Internal
+		}
+	}
+
+	return ""
+}
+
+func (d *Driver) removeFromLoadBalancerPool(c *clc.Client, s server.Server) error {
+	ip := privateIPFromServer(s)
+	if ip == "" {
+		return nil
+	}
+
+	log.Infof("Deregistering '%s' from load balancer pool '%s'...", ip, d.LoadBalancerID)
+
+	return c.LB.RemoveNode(d.GroupID, d.LoadBalancerID, ip)
+}
+
 func (d *Driver) sshKeyPath() string {
 	return filepath.Join(d.storePath, "id_rsa")
 }
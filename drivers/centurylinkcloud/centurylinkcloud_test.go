@@ -0,0 +1,95 @@
+package centurylinkcloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CenturyLinkCloud/clc-sdk/status"
+)
+
+func TestWaitOptions(t *testing.T) {
+	cases := []struct {
+		name           string
+		timeout, sleep string
+		wantTimeout    time.Duration
+		wantSleep      time.Duration
+	}{
+		{"defaults when unset", "", "", defaultOperationTimeout, defaultOperationSleep},
+		{"valid overrides", "5m", "1s", 5 * time.Minute, 1 * time.Second},
+		{"invalid values fall back to defaults", "not-a-duration", "also-bad", defaultOperationTimeout, defaultOperationSleep},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &Driver{OperationTimeout: c.timeout, OperationSleep: c.sleep}
+			opts := d.waitOptions()
+			if opts.Timeout != c.wantTimeout {
+				t.Errorf("Timeout = %s, want %s", opts.Timeout, c.wantTimeout)
+			}
+			if opts.Sleep != c.wantSleep {
+				t.Errorf("Sleep = %s, want %s", opts.Sleep, c.wantSleep)
+			}
+		})
+	}
+}
+
+func TestNextOperationSleep(t *testing.T) {
+	sleep := defaultOperationSleep
+	for i := 0; i < 20; i++ {
+		next := nextOperationSleep(sleep)
+		if next < sleep {
+			t.Fatalf("sleep shrank from %s to %s", sleep, next)
+		}
+		if next > maxOperationSleep {
+			t.Fatalf("sleep %s exceeded cap %s", next, maxOperationSleep)
+		}
+		sleep = next
+	}
+	if sleep != maxOperationSleep {
+		t.Errorf("sleep = %s after growing, want it to have settled at the %s cap", sleep, maxOperationSleep)
+	}
+}
+
+func TestJitterFor(t *testing.T) {
+	sleep := 10 * time.Second
+	for i := 0; i < 100; i++ {
+		j := jitterFor(sleep)
+		if j < 0 || j > sleep/2 {
+			t.Fatalf("jitterFor(%s) = %s, want within [0, %s]", sleep, j, sleep/2)
+		}
+	}
+}
+
+func TestWaitForStatusAlreadySucceeded(t *testing.T) {
+	d := &Driver{}
+	st := status.Status{Status: "succeeded"}
+
+	// A nil *clc.Client is safe here: an already-succeeded status must
+	// return without ever touching the client.
+	if err := d.waitForStatus(nil, st, d.waitOptions()); err != nil {
+		t.Errorf("waitForStatus() = %v, want nil", err)
+	}
+}
+
+func TestWaitForStatusFails(t *testing.T) {
+	d := &Driver{}
+	st := status.Status{ID: "wf-1", Status: "failed"}
+
+	// A nil *clc.Client is safe here: an already-failed status must be
+	// reported immediately, without polling for a fresh one.
+	err := d.waitForStatus(nil, st, d.waitOptions())
+	if err == nil || err == ErrOperationTimeout {
+		t.Errorf("waitForStatus() = %v, want a descriptive failure error", err)
+	}
+}
+
+func TestWaitForStatusTimesOut(t *testing.T) {
+	d := &Driver{}
+	st := status.Status{Status: "pending"}
+	opts := WaitOptions{Timeout: 1 * time.Nanosecond, Sleep: defaultOperationSleep}
+
+	err := d.waitForStatus(nil, st, opts)
+	if err != ErrOperationTimeout {
+		t.Errorf("waitForStatus() = %v, want ErrOperationTimeout", err)
+	}
+}
@@ -1,12 +1,17 @@
 package centurylinkcloud
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"time"
+	"path/filepath"
+	"sync"
 
-	"github.com/CenturyLinkLabs/clcgo"
+	clc "github.com/CenturyLinkCloud/clc-sdk"
+	"github.com/CenturyLinkCloud/clc-sdk/lb"
+	"github.com/CenturyLinkCloud/clc-sdk/server"
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/docker/machine/ssh"
@@ -53,6 +58,75 @@ func getCreateFlags() []cli.Flag {
 			Usage:  "CenturyLink Cloud Memory GB",
 			Value:  2,
 		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_ANTI_AFFINITY_POLICY_ID",
+			Name:   "centurylinkcloud-anti-affinity-policy-id",
+			Usage:  "CenturyLink Cloud Anti Affinity Policy ID",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_ALERT_POLICY_ID",
+			Name:   "centurylinkcloud-alert-policy-id",
+			Usage:  "CenturyLink Cloud Alert Policy ID",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_LOAD_BALANCER_ID",
+			Name:   "centurylinkcloud-load-balancer-id",
+			Usage:  "CenturyLink Cloud Shared Load Balancer ID to register this server behind",
+		},
+		cli.IntFlag{
+			EnvVar: "CENTURYLINKCLOUD_LOAD_BALANCER_POOL_PORT",
+			Name:   "centurylinkcloud-load-balancer-pool-port",
+			Usage:  "Port to register with the shared load balancer pool",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_OPERATION_TIMEOUT",
+			Name:   "centurylinkcloud-operation-timeout",
+			Usage:  "Total time to wait for a CLC operation (create, delete, power) to finish",
+			Value:  "20m",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_OPERATION_SLEEP",
+			Name:   "centurylinkcloud-operation-sleep",
+			Usage:  "Initial delay between CLC operation status polls, growing 1.5x per attempt up to a 30s cap",
+			Value:  "2s",
+		},
+		cli.StringSliceFlag{
+			EnvVar: "CENTURYLINKCLOUD_OPEN_TCP_PORTS",
+			Name:   "centurylinkcloud-open-tcp-ports",
+			Usage:  "Make the given TCP port accessible from the Internet, in addition to 22 and 2376",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringSliceFlag{
+			EnvVar: "CENTURYLINKCLOUD_OPEN_UDP_PORTS",
+			Name:   "centurylinkcloud-open-udp-ports",
+			Usage:  "Make the given UDP port accessible from the Internet",
+			Value:  &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			EnvVar: "VAULT_ADDR",
+			Name:   "centurylinkcloud-vault-addr",
+			Usage:  "HashiCorp Vault address to fetch CLC credentials from instead of a password",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_VAULT_PATH",
+			Name:   "centurylinkcloud-vault-path",
+			Usage:  "Vault path holding bearer_token/account_alias or username/password for CLC",
+		},
+		cli.StringFlag{
+			EnvVar: "VAULT_TOKEN",
+			Name:   "centurylinkcloud-vault-token",
+			Usage:  "Vault token used to read --centurylinkcloud-vault-path",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_USER_DATA",
+			Name:   "centurylinkcloud-user-data",
+			Usage:  "Inline user-data script to run over SSH before Docker is installed",
+		},
+		cli.StringFlag{
+			EnvVar: "CENTURYLINKCLOUD_USER_DATA_FILE",
+			Name:   "centurylinkcloud-user-data-file",
+			Usage:  "Path to a user-data script to run over SSH before Docker is installed, takes precedence over --centurylinkcloud-user-data",
+		},
 	}
 }
 
@@ -75,7 +149,19 @@ func (d *Driver) Create() error {
 		return err
 	}
 
-	if err = d.generateAndWriteSSHKey(c, s); err != nil {
+	if d.LoadBalancerID != "" {
+		if err := d.registerWithLoadBalancerPool(c, s); err != nil {
+			return err
+		}
+	}
+
+	client, err := d.generateAndWriteSSHKey(c, s)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := d.runUserData(client); err != nil {
 		return err
 	}
 
@@ -90,64 +176,119 @@ func (d *Driver) Create() error {
 	return nil
 }
 
-func (d *Driver) createServer(c *clcgo.Client) (clcgo.Server, error) {
+func (d *Driver) createServer(c *clc.Client) (server.Server, error) {
 	log.Infof("Creating server...")
 
-	s := clcgo.Server{
-		Name:           d.ServerName,
-		GroupID:        d.GroupID,
-		SourceServerID: d.SourceServerID,
-		CPU:            d.CPU,
-		MemoryGB:       d.MemoryGB,
-		Type:           "standard",
+	spec := server.CreateServer{
+		Name:                 d.ServerName,
+		GroupID:              d.GroupID,
+		SourceServerID:       d.SourceServerID,
+		CPU:                  d.CPU,
+		MemoryGB:             d.MemoryGB,
+		Type:                 "standard",
+		AntiAffinityPolicyID: d.AntiAffinityPolicyID,
 	}
 
-	st, err := c.SaveEntity(&s)
+	st, err := c.Server.Create(spec)
 	if err != nil {
-		return s, logAndReturnError(err)
+		return server.Server{}, logAndReturnError(err)
 	}
 
-	for !st.HasSucceeded() {
-		time.Sleep(time.Second * statusWaitSeconds)
-		log.Debugf("Checking status...")
-		if err := c.GetEntity(&st); err != nil {
-			return s, err
-		}
+	// CLC has already started provisioning st.ServerID at this point, so
+	// note it on the driver now: every error path below leaves the server
+	// reapable via `machine rm` even though Create() discards the
+	// server.Server this function returns on error.
+	d.ServerID = st.ServerID
+
+	if err := d.waitForStatus(c, st, d.waitOptions()); err != nil {
+		return server.Server{ID: st.ServerID}, err
 	}
 
-	if err = c.GetEntity(&s); err != nil {
-		return s, err
+	s, err := c.Server.Get(st.ServerID)
+	if err != nil {
+		return server.Server{ID: st.ServerID}, err
 	}
-	d.ServerID = s.ID
 	log.Infof("Server '%s' is provisioned", s.Name)
 
+	if d.AlertPolicyID != "" {
+		log.Infof("Attaching alert policy '%s'...", d.AlertPolicyID)
+		if err := c.Alert.Attach(s.ID, d.AlertPolicyID); err != nil {
+			log.Errorf("server '%s' was fully provisioned but alert policy attach failed, it must be cleaned up manually if abandoned: %v", s.ID, err)
+			return s, logAndReturnError(err)
+		}
+	}
+
 	return s, nil
 }
 
-func (d Driver) addPublicIPAddress(c *clcgo.Client, s *clcgo.Server) error {
-	log.Infof("Adding public IP address...")
+func (d *Driver) registerWithLoadBalancerPool(c *clc.Client, s server.Server) error {
+	ip := privateIPFromServer(s)
+	if ip == "" {
+		return errors.New("could not find a private IP Address for the server")
+	}
+
+	log.Infof("Registering '%s' with load balancer pool '%s'...", ip, d.LoadBalancerID)
 
-	ports := []clcgo.Port{
+	node := lb.Node{IPAddress: ip, PrivatePort: d.LoadBalancerPoolPort}
+	if err := c.LB.AddNode(d.GroupID, d.LoadBalancerID, node); err != nil {
+		return logAndReturnError(err)
+	}
+
+	log.Infof("Server is behind load balancer '%s'", d.LoadBalancerID)
+
+	return nil
+}
+
+// openPorts merges the ports Docker itself needs (SSH and the Docker
+// daemon) with the TCP/UDP ports the user asked to expose, deduplicating
+// along the way.
+func (d Driver) openPorts() []server.Port {
+	ports := []server.Port{
 		{Protocol: "TCP", Port: 22},   // SSH
 		{Protocol: "TCP", Port: 2376}, // Docker
 	}
-	a := clcgo.PublicIPAddress{Server: *s, Ports: ports}
-	st, err := c.SaveEntity(&a)
+	seen := make(map[server.Port]bool)
+	for _, p := range ports {
+		seen[p] = true
+	}
+
+	for _, p := range d.OpenTCPPorts {
+		port := server.Port{Protocol: "TCP", Port: p}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	for _, p := range d.OpenUDPPorts {
+		port := server.Port{Protocol: "UDP", Port: p}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+
+	return ports
+}
+
+func (d Driver) addPublicIPAddress(c *clc.Client, s *server.Server) error {
+	log.Infof("Adding public IP address...")
+
+	ports := d.openPorts()
+	req := server.PublicIPAddress{Ports: ports, InternalIPAddress: privateIPFromServer(*s)}
+	st, err := c.Server.AddPublicIPAddress(s.ID, req)
 	if err != nil {
 		return logAndReturnError(err)
 	}
-	for !st.HasSucceeded() {
-		time.Sleep(time.Second * statusWaitSeconds)
-		log.Debugf("Checking status...")
-		err = c.GetEntity(&st)
-		if err != nil {
-			return err
-		}
+	if err := d.waitForStatus(c, st, d.waitOptions()); err != nil {
+		return err
 	}
 
-	if err := c.GetEntity(s); err != nil {
+	refreshed, err := c.Server.Get(s.ID)
+	if err != nil {
 		return err
 	}
+	*s = refreshed
+
 	ip := publicIPFromServer(*s)
 	if ip == "" {
 		return errors.New("could not find an IP Address for the server")
@@ -158,10 +299,14 @@ func (d Driver) addPublicIPAddress(c *clcgo.Client, s *clcgo.Server) error {
 	return nil
 }
 
-func (d Driver) generateAndWriteSSHKey(c *clcgo.Client, s clcgo.Server) error {
-	cr := clcgo.Credentials{Server: s}
-	if err := c.GetEntity(&cr); err != nil {
-		return err
+// generateAndWriteSSHKey logs into the freshly-provisioned server with its
+// generated root password, installs our own SSH key, and returns the dialed
+// client so later steps (namely runUserData) can reuse the same connection
+// instead of paying for another root-password login.
+func (d Driver) generateAndWriteSSHKey(c *clc.Client, s server.Server) (*xssh.Client, error) {
+	cr, err := c.Server.GetCredentials(s.ID)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Infof("Waiting for SSH...")
@@ -169,7 +314,7 @@ func (d Driver) generateAndWriteSSHKey(c *clcgo.Client, s clcgo.Server) error {
 	ip := publicIPFromServer(s)
 	sshAddress := fmt.Sprintf("%s:%d", ip, 22)
 	if err := ssh.WaitForTCP(sshAddress); err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Debugf("Logging in using root password...")
@@ -182,34 +327,161 @@ func (d Driver) generateAndWriteSSHKey(c *clcgo.Client, s clcgo.Server) error {
 
 	client, err := xssh.Dial("tcp", sshAddress, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer client.Close()
 
 	ss, err := client.NewSession()
 	if err != nil {
-		return err
+		client.Close()
+		return nil, err
 	}
 
 	if err := ssh.GenerateSSHKey(d.sshKeyPath()); err != nil {
-		return err
+		client.Close()
+		return nil, err
 	}
 
 	publicSSHKeyPath := d.sshKeyPath() + ".pub"
 	pk, err := ioutil.ReadFile(publicSSHKeyPath)
 	if err != nil {
-		return err
+		client.Close()
+		return nil, err
 	}
 
 	log.Debugf("Adding public key to authorized_keys...")
-	err = ss.Run(fmt.Sprintf(`echo "%s" >> ~/.ssh/authorized_keys`, string(pk)))
+	if err := ss.Run(fmt.Sprintf(`echo "%s" >> ~/.ssh/authorized_keys`, string(pk))); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// runUserData uploads the configured --centurylinkcloud-user-data(-file) script and runs it with sudo.
+func (d *Driver) runUserData(client *xssh.Client) error {
+	if d.UserData == "" {
+		return nil
+	}
+
+	const remotePath = "/tmp/machine-user-data.sh"
+
+	log.Infof("Uploading user-data script...")
+	if err := scpUpload(client, remotePath, []byte(d.UserData)); err != nil {
+		return fmt.Errorf("unable to upload user-data script: %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := session.StderrPipe()
 	if err != nil {
 		return err
 	}
 
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go streamToLog(&wg, stdout)
+	go streamToLog(&wg, stderr)
+
+	log.Infof("Running user-data script...")
+	if err := session.Start(fmt.Sprintf("chmod +x %s && sudo %s", remotePath, remotePath)); err != nil {
+		return fmt.Errorf("user-data script failed to start: %v", err)
+	}
+
+	wg.Wait()
+
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("user-data script failed: %v", err)
+	}
+
 	return nil
 }
 
+// streamToLog copies lines from r to the logger at Info level as they arrive.
+func streamToLog(wg *sync.WaitGroup, r io.Reader) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Infof("user-data: %s", scanner.Text())
+	}
+}
+
+// scpUpload writes content to remotePath over client using the minimal "scp -t" sink protocol.
+func scpUpload(client *xssh.Client, remotePath string, content []byte) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.Start(fmt.Sprintf("scp -qt %s", filepath.Dir(remotePath))); err != nil {
+		return err
+	}
+
+	if err := scpSendFile(stdin, stdout, filepath.Base(remotePath), content); err != nil {
+		return err
+	}
+
+	return session.Wait()
+}
+
+// scpSendFile speaks the source side of the minimal scp sink protocol, checking all three acks.
+func scpSendFile(w io.WriteCloser, r io.Reader, name string, content []byte) error {
+	defer w.Close()
+
+	readAck := func() error {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("reading scp ack: %v", err)
+		}
+		if buf[0] != 0 {
+			return fmt.Errorf("remote scp rejected the transfer (code %d)", buf[0])
+		}
+		return nil
+	}
+
+	// scp -t sends an initial readiness byte before it has seen anything
+	// from us. Skipping this would shift every later ack read back by
+	// one, so this always-zero byte would be taken as the header's ack and
+	// a rejected header would only surface after the content was sent.
+	if err := readAck(); err != nil {
+		return fmt.Errorf("waiting for scp sink to become ready: %v", err)
+	}
+
+	if _, err := fmt.Fprintf(w, "C0755 %d %s\n", len(content), name); err != nil {
+		return fmt.Errorf("writing scp header: %v", err)
+	}
+	if err := readAck(); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("writing scp file content: %v", err)
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
+		return fmt.Errorf("writing scp trailer: %v", err)
+	}
+
+	return readAck()
+}
+
 func (d *Driver) installDocker() error {
 	log.Debugf("Installing Docker...")
 	cmd, err := d.GetSSHCommand("if [ ! -e /usr/bin/docker ]; then curl -sL https://get.docker.com | sh -; fi")
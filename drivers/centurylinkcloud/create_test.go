@@ -0,0 +1,38 @@
+package centurylinkcloud
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestScpSendFile(t *testing.T) {
+	var out bytes.Buffer
+	// readiness ack, header ack, final ack: all accepted (0).
+	in := bytes.NewReader([]byte{0, 0, 0})
+
+	if err := scpSendFile(nopWriteCloser{&out}, in, "file.txt", []byte("hello")); err != nil {
+		t.Fatalf("scpSendFile() = %v, want nil", err)
+	}
+
+	want := "C0755 5 file.txt\nhello\x00"
+	if out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+}
+
+func TestScpSendFileRejectsHeaderAck(t *testing.T) {
+	var out bytes.Buffer
+	// readiness ack accepted, header ack rejected.
+	in := bytes.NewReader([]byte{0, 1})
+
+	if err := scpSendFile(nopWriteCloser{&out}, in, "file.txt", []byte("hello")); err == nil {
+		t.Fatal("scpSendFile() = nil, want error for a rejected header ack")
+	}
+}
@@ -0,0 +1,98 @@
+package centurylinkcloud
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/CenturyLinkCloud/clc-sdk/api"
+	vaultapi "github.com/hashicorp/vault/api"
+	"golang.org/x/net/context"
+)
+
+// CredentialProvider resolves the CLC API credentials a Driver should
+// authenticate with. It's consulted at client construction and again on a
+// 401, so implementations must be safe to call more than once and long-lived
+// hosts can rotate credentials without a human in the loop.
+type CredentialProvider interface {
+	Fetch(ctx context.Context) (api.Credentials, error)
+}
+
+type passwordCredentialProvider struct {
+	username string
+	password string
+}
+
+func (p *passwordCredentialProvider) Fetch(ctx context.Context) (api.Credentials, error) {
+	password := p.password
+	if password == "" {
+		fmt.Printf(passwordPrompt)
+		reader := bufio.NewReader(os.Stdin)
+		input, err := reader.ReadString('\n')
+		if err != nil {
+			return api.Credentials{}, err
+		}
+		password = strings.TrimSpace(input)
+	}
+
+	return api.Credentials{Username: p.username, Password: password}, nil
+}
+
+// VaultCredentialProvider reads CLC credentials out of a HashiCorp Vault
+// secret, which may contain either a ready-to-use bearer_token/account_alias
+// pair, or a username/password to exchange for one.
+type VaultCredentialProvider struct {
+	Addr  string
+	Path  string
+	Token string
+
+	client *vaultapi.Client
+}
+
+func NewVaultCredentialProvider(addr, path, token string) (*VaultCredentialProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("centurylinkcloud driver requires --centurylinkcloud-vault-path when --centurylinkcloud-vault-addr is set")
+	}
+
+	cfg := vaultapi.DefaultConfig()
+	if err := cfg.ReadEnvironment(); err != nil {
+		return nil, err
+	}
+	if addr != "" {
+		cfg.Address = addr
+	}
+
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		client.SetToken(token)
+	}
+
+	return &VaultCredentialProvider{Addr: addr, Path: path, Token: token, client: client}, nil
+}
+
+func (v *VaultCredentialProvider) Fetch(ctx context.Context) (api.Credentials, error) {
+	secret, err := v.client.Logical().Read(v.Path)
+	if err != nil {
+		return api.Credentials{}, fmt.Errorf("unable to read vault secret at '%s': %v", v.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return api.Credentials{}, fmt.Errorf("no secret found at vault path '%s'", v.Path)
+	}
+
+	if token, ok := secret.Data["bearer_token"].(string); ok && token != "" {
+		alias, _ := secret.Data["account_alias"].(string)
+		return api.Credentials{BearerToken: token, AccountAlias: alias}, nil
+	}
+
+	username, _ := secret.Data["username"].(string)
+	password, _ := secret.Data["password"].(string)
+	if username == "" || password == "" {
+		return api.Credentials{}, fmt.Errorf("vault secret at '%s' must contain either bearer_token/account_alias or username/password", v.Path)
+	}
+
+	return api.Credentials{Username: username, Password: password}, nil
+}
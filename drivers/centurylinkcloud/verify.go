@@ -0,0 +1,141 @@
+package centurylinkcloud
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// GetVerifyFlags reuses the create flags, since verifying a configuration
+// means provisioning a disposable server with the same options. NOTE: no
+// `machine verify` subcommand exists yet to call this or Verify() below —
+// drivers.RegisteredDriver has no slot for a verify flags/action pair, so
+// wiring one in is command-registration work outside this driver package.
+func (d *Driver) GetVerifyFlags() []cli.Flag {
+	return getCreateFlags()
+}
+
+// verifyPhase records how long one stage of the verification run took, and
+// whether it failed.
+type verifyPhase struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Verify exercises the full provisioning path against the real CLC API:
+// create a disposable server, wait for it to boot, open port 22, SSH in and
+// run a couple of sanity commands, then unconditionally tear the server back
+// down. It is a smoke test to run ahead of a user committing to a
+// long-lived host; no `machine verify` subcommand calls it (see
+// GetVerifyFlags).
+func (d *Driver) Verify() error {
+	var phases []verifyPhase
+	var instanceID, publicIP string
+	verdict := "PASS"
+
+	run := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		phases = append(phases, verifyPhase{Name: name, Duration: time.Since(start), Err: err})
+		return err
+	}
+
+	defer func() {
+		log.Infof("Verify summary for '%s':", d.ServerName)
+		log.Infof("  instance_id: %s", instanceID)
+		log.Infof("  public_ip:   %s", publicIP)
+		for _, p := range phases {
+			status := "ok"
+			if p.Err != nil {
+				status = fmt.Sprintf("failed: %v", p.Err)
+			}
+			log.Infof("  phase=%-10s duration=%-10s status=%s", p.Name, p.Duration, status)
+		}
+		log.Infof("  verdict: %s", verdict)
+	}()
+
+	c, err := d.getClientWithPersistence()
+	if err != nil {
+		verdict = "FAIL"
+		return err
+	}
+
+	if err := run("create", func() error {
+		s, err := d.createServer(c)
+		instanceID = s.ID
+		if err != nil {
+			return err
+		}
+		return d.addPublicIPAddress(c, &s)
+	}); err != nil {
+		verdict = "FAIL"
+	} else {
+		publicIP, _ = d.GetIP()
+
+		if err := run("ssh", func() error {
+			_, s, err := d.getServer()
+			if err != nil {
+				return err
+			}
+			client, err := d.generateAndWriteSSHKey(c, s)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			// Verify is meant to exercise the same path Create() does, so a bare
+			// template without Docker on it (the default SourceServerID is
+			// plain Ubuntu) needs Docker installed before "docker version" can
+			// mean anything.
+			if err := d.installDocker(); err != nil {
+				return err
+			}
+
+			out, err := d.runVerifyCommand("docker version && uname -a")
+			if err != nil {
+				return fmt.Errorf("smoke test commands failed: %v\n%s", err, out)
+			}
+			log.Debugf("Verify SSH output:\n%s", out)
+
+			return nil
+		}); err != nil {
+			verdict = "FAIL"
+		}
+	}
+
+	// Tear down whatever got created, even if a later phase (or create
+	// itself, partway through) failed — this run's server has no other
+	// owner.
+	if instanceID != "" {
+		if err := run("teardown", func() error {
+			return d.Remove()
+		}); err != nil {
+			log.Errorf("failed to tear down verify server '%s', it must be reaped manually: %v", instanceID, err)
+			verdict = "FAIL"
+		}
+	}
+
+	if verdict != "PASS" {
+		return fmt.Errorf("centurylinkcloud verify failed for instance '%s'", instanceID)
+	}
+
+	return nil
+}
+
+func (d *Driver) runVerifyCommand(command string) (string, error) {
+	cmd, err := d.GetSSHCommand(command)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+
+	return out.String(), err
+}
@@ -0,0 +1,24 @@
+package centurylinkcloud
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetVerifyFlagsMatchesCreateFlags(t *testing.T) {
+	d := &Driver{}
+	if !reflect.DeepEqual(d.GetVerifyFlags(), getCreateFlags()) {
+		t.Errorf("GetVerifyFlags() diverged from getCreateFlags(); verify should provision with the same options create does")
+	}
+}
+
+func TestVerifyFailsFastOnBadCredentialConfig(t *testing.T) {
+	// A Vault addr with no path is rejected by NewVaultCredentialProvider
+	// before any network call is made, so this exercises Verify()'s
+	// early-exit without needing a real CLC account or SSH access.
+	d := &Driver{ServerName: "verify-test", VaultAddr: "http://vault.example.com"}
+
+	if err := d.Verify(); err == nil {
+		t.Error("Verify() = nil, want an error from an unconfigured credential provider")
+	}
+}